@@ -0,0 +1,235 @@
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/plentico/plenti/common"
+)
+
+// looksLikeCommonJS is a cheap heuristic for whether a resolved .js entry is
+// written as CommonJS rather than ESM. It doesn't attempt to actually parse
+// CJS, it just checks for the handful of globals only CJS modules reference.
+func looksLikeCommonJS(src []byte) bool {
+	return bytes.Contains(src, []byte("require(")) ||
+		bytes.Contains(src, []byte("module.exports")) ||
+		bytes.Contains(src, []byte("exports."))
+}
+
+// reCJSNamedExport finds static `exports.foo = ...` / `module.exports.foo =
+// ...` assignments so the ESM wrapper can re-export foo by name in addition
+// to the default export.
+var reCJSNamedExport = regexp.MustCompile(`(?:module\.exports|exports)\.([A-Za-z_$][A-Za-z0-9_$]*)\s*=`)
+
+// convertCJSToESM wraps a CommonJS source file's body in an IIFE that
+// populates a synthesized `module.exports`, hoists every `require('x')` call
+// into a static `import * as __dep_N from 'x'`, and re-exports
+// `module.exports` both as the default export and, for every statically
+// discovered `exports.foo = ` assignment, as a named export.
+//
+// buildPath/nodeModulesDir/scope let a bare (non-relative) require specifier
+// be resolved the same way a top-level npm import is: nodeModulesDir is
+// searched (honoring Node's upward node_modules hoisting) for the required
+// package, which is copied/converted and recorded in the import map under
+// scope, so the hoisted `import ... from '<specifier>'` resolves to a real
+// public URL instead of an unresolvable bare specifier. A relative require
+// (e.g. "./utils") is left as-is in the hoisted import, to be resolved by
+// the browser against the converted file's URL; the file it names is not
+// converted to ESM.
+//
+// visited tracks the entry files already being converted higher up this same
+// call stack, so a circular CommonJS require graph (A requires B, B requires
+// A - legal and common in CJS) doesn't recurse forever.
+func convertCJSToESM(src []byte, buildPath, nodeModulesDir, scope string, visited map[string]bool) []byte {
+	requires := parseRequires(src)
+
+	var hoisted bytes.Buffer
+	var body bytes.Buffer
+	cursor := 0
+	for i, req := range requires {
+		body.Write(src[cursor:req.Start])
+		depVar := fmt.Sprintf("__dep_%d", i)
+		specifier := req.Specifier
+		if !strings.HasPrefix(specifier, ".") && specifier != "" {
+			if publicURL, ok := resolveTransitiveRequire(specifier, buildPath, nodeModulesDir, scope, visited); ok {
+				specifier = publicURL
+			}
+		}
+		fmt.Fprintf(&hoisted, "import * as %s from '%s';\nconst %s_cjs = %s.default ?? %s;\n",
+			depVar, specifier, depVar, depVar, depVar)
+		body.WriteString(depVar + "_cjs")
+		cursor = req.End
+	}
+	body.Write(src[cursor:])
+
+	var out bytes.Buffer
+	out.Write(hoisted.Bytes())
+	out.WriteString("const module = { exports: {} };\nconst exports = module.exports;\n(function () {\n")
+	out.Write(body.Bytes())
+	out.WriteString("\n})();\n")
+	out.WriteString("export default module.exports;\n")
+	if namedExports := findCJSNamedExports(src); len(namedExports) > 0 {
+		fmt.Fprintf(&out, "export const { %s } = module.exports;\n", strings.Join(namedExports, ", "))
+	}
+	return out.Bytes()
+}
+
+// cjsReservedExportNames are `exports.foo = ` assignments that can't become
+// `const foo` bindings: "default" is a reserved word (and is already covered
+// by the `export default module.exports` line above), and "__esModule" is a
+// Babel-emitted marker property, not a real export.
+var cjsReservedExportNames = map[string]bool{
+	"default":    true,
+	"__esModule": true,
+}
+
+func findCJSNamedExports(src []byte) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, match := range reCJSNamedExport.FindAllSubmatch(src, -1) {
+		name := string(match[1])
+		if seen[name] || cjsReservedExportNames[name] || !isValidBindingName(name) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// isValidBindingName reports whether name can legally appear as a `const`
+// binding, i.e. it's not a reserved word.
+func isValidBindingName(name string) bool {
+	return !jsReservedWords[name]
+}
+
+// jsReservedWords are ES reserved words that can't be used as a `const`/
+// `let`/`var` binding name.
+var jsReservedWords = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true,
+	"continue": true, "debugger": true, "default": true, "delete": true, "do": true,
+	"else": true, "export": true, "extends": true, "finally": true, "for": true,
+	"function": true, "if": true, "import": true, "in": true, "instanceof": true,
+	"new": true, "return": true, "super": true, "switch": true, "this": true,
+	"throw": true, "try": true, "typeof": true, "var": true, "void": true,
+	"while": true, "with": true, "yield": true, "let": true, "static": true,
+	"enum": true, "await": true, "implements": true, "package": true,
+	"protected": true, "interface": true, "private": true, "public": true,
+	"null": true, "true": true, "false": true,
+}
+
+// cjsCacheKey derives a stable cache filename from the source file's mtime
+// and size, so an unchanged CJS dependency doesn't need to be re-read and
+// re-converted on every build.
+func cjsCacheKey(info os.FileInfo) string {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d-%d", info.ModTime().UnixNano(), info.Size())
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+// nearestPackageDir walks up from the directory containing entryFile looking
+// for the nearest ancestor holding a package.json, i.e. the root of the npm
+// package entryFile belongs to. It's used to find that package's own
+// node_modules, so a require() inside it resolves transitive dependencies
+// the same way Node itself would, instead of only ever looking in the site's
+// top-level node_modules.
+func nearestPackageDir(entryFile string) string {
+	dir := filepath.Dir(entryFile)
+	for {
+		if fileExists(filepath.Join(dir, "package.json")) {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return filepath.Dir(entryFile)
+		}
+		dir = parent
+	}
+}
+
+// resolveTransitiveRequire resolves a bare specifier required from within a
+// CommonJS entry that's itself an npm dependency: it's copied/converted into
+// web_modules and recorded in the import map under scope exactly like a
+// top-level npm import, and its resolved public URL is returned so the
+// hoisted `import` in convertCJSToESM can reference it directly rather than
+// an unresolvable bare specifier. visited is forwarded to convertCJSEntry to
+// guard against circular requires.
+func resolveTransitiveRequire(specifier, buildPath, nodeModulesDir, scope string, visited map[string]bool) (string, bool) {
+	entryFile, publicURL, err := resolveNpmEntry(specifier, nodeModulesDir)
+	if err != nil {
+		fmt.Printf("Could not resolve transitive require '%s': %s\n", specifier, err)
+		return "", false
+	}
+
+	pkgName, _ := splitModuleSpecifier(specifier)
+	copyNpmModule(pkgName, buildPath+"/spa/web_modules")
+	resolvedPath := buildPath + publicURL
+
+	if filepath.Ext(resolvedPath) == ".js" {
+		pkgCacheDir := filepath.Dir(resolvedPath)
+		convertedPath, convertErr := convertCJSEntry(entryFile, buildPath, pkgCacheDir, nearestPackageDir(entryFile)+"/node_modules", scope, visited)
+		if convertErr != nil {
+			fmt.Printf("Could not convert transitive CJS module '%s' to ESM: %s\n", specifier, convertErr)
+		} else {
+			resolvedPath = convertedPath
+		}
+	}
+
+	mappedURL := "/" + strings.TrimPrefix(strings.Replace(resolvedPath, buildPath, "", 1), "/")
+	recordImportMapEntry(scope, specifier, mappedURL)
+	return mappedURL, true
+}
+
+// convertCJSEntry converts entryFile to ESM and caches the result under
+// cacheDir/<hash>.mjs if entryFile looks like CommonJS, returning the path
+// to the converted file. If entryFile doesn't look like CommonJS it's
+// returned unchanged. nodeModulesDir/scope are threaded through to
+// convertCJSToESM so any require() inside entryFile that itself names a bare
+// npm specifier can be resolved relative to entryFile's own package.
+//
+// visited records every entry file already being converted further up this
+// call stack (callers should pass a fresh map per top-level conversion). CJS
+// modules are free to require each other circularly (A requires B, B
+// requires A), so re-entering an entryFile already in visited doesn't
+// recurse again - it returns the cache path this entry will be written to
+// once the outer call finishes, which is fully determined by entryFile's own
+// mtime+size and therefore safe to hand out before that write happens.
+func convertCJSEntry(entryFile, buildPath, cacheDir, nodeModulesDir, scope string, visited map[string]bool) (string, error) {
+	info, err := os.Stat(entryFile)
+	if err != nil {
+		return "", fmt.Errorf("Could not stat %s to check for CJS conversion: %w%s\n", entryFile, err, common.Caller())
+	}
+
+	cachedPath := filepath.Join(cacheDir, cjsCacheKey(info)+".mjs")
+	if visited[entryFile] {
+		return cachedPath, nil
+	}
+	visited[entryFile] = true
+
+	src, err := ioutil.ReadFile(entryFile)
+	if err != nil {
+		return "", fmt.Errorf("Could not read %s to check for CJS conversion: %w%s\n", entryFile, err, common.Caller())
+	}
+	if !looksLikeCommonJS(src) {
+		return entryFile, nil
+	}
+
+	if _, err := os.Stat(cachedPath); err == nil {
+		// Cache hit: source's mtime+size haven't changed since last build.
+		return cachedPath, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("Could not create CJS conversion cache dir %s: %w%s\n", cacheDir, err, common.Caller())
+	}
+	if err := ioutil.WriteFile(cachedPath, convertCJSToESM(src, buildPath, nodeModulesDir, scope, visited), 0644); err != nil {
+		return "", fmt.Errorf("Could not write converted CJS module %s: %w%s\n", cachedPath, err, common.Caller())
+	}
+	return cachedPath, nil
+}
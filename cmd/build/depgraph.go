@@ -0,0 +1,167 @@
+package build
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/plentico/plenti/common"
+)
+
+// depGraphPath is where the dependency graph built by Gopack is persisted
+// between builds so an incremental build can skip files that haven't
+// changed.
+const depGraphPath = ".plenti-cache/gopack.json"
+
+// Node is everything recorded about a single file Gopack has processed.
+// Imports/Scoped cache that file's contribution to ImportMap/ImportMapScopes
+// so a file can be skipped on an incremental build without losing the
+// import map entries it would otherwise have produced. No hash is recorded
+// for a resolved npm entry, so a file that imports an npm module always
+// counts as dirty in isDirty and is reprocessed on every build.
+type Node struct {
+	Path    string            `json:"path"`
+	Imports map[string]string `json:"imports,omitempty"`
+	Scoped  map[string]string `json:"scoped,omitempty"`
+}
+
+// DepGraph is Gopack's persistent view of the site's module dependency
+// graph: which files import which other files (Edges), and a content hash
+// for each file (Hashes) used to tell whether it needs to be reprocessed.
+type DepGraph struct {
+	Nodes  map[string]*Node    `json:"nodes"`
+	Edges  map[string][]string `json:"edges"`
+	Hashes map[string]string   `json:"hashes"`
+
+	mu sync.Mutex
+}
+
+func newDepGraph() *DepGraph {
+	return &DepGraph{
+		Nodes:  map[string]*Node{},
+		Edges:  map[string][]string{},
+		Hashes: map[string]string{},
+	}
+}
+
+// loadDepGraph reads the persisted graph from depGraphPath, returning a
+// fresh empty graph (rather than an error) if it doesn't exist yet or is
+// unreadable, since a missing cache just means a full rebuild.
+func loadDepGraph() *DepGraph {
+	raw, err := ioutil.ReadFile(depGraphPath)
+	if err != nil {
+		return newDepGraph()
+	}
+	graph := newDepGraph()
+	if err := json.Unmarshal(raw, graph); err != nil {
+		fmt.Printf("Could not parse %s, rebuilding Gopack cache from scratch: %s\n", depGraphPath, err)
+		return newDepGraph()
+	}
+	return graph
+}
+
+// save persists the graph to depGraphPath.
+func (g *DepGraph) save() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(depGraphPath), os.ModePerm); err != nil {
+		return fmt.Errorf("Could not create %s: %w%s\n", filepath.Dir(depGraphPath), err, common.Caller())
+	}
+	raw, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Could not marshal Gopack dependency graph: %w%s\n", err, common.Caller())
+	}
+	if err := ioutil.WriteFile(depGraphPath, raw, 0644); err != nil {
+		return fmt.Errorf("Could not write %s: %w%s\n", depGraphPath, err, common.Caller())
+	}
+	return nil
+}
+
+// hashFile returns a content hash for path, used to detect whether a file
+// changed since the last build.
+func hashFile(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordNode updates the graph with path's current hash, the specifiers it
+// imports (edges), and the import map entries it contributed.
+func (g *DepGraph) recordNode(path, hash string, edges []string, imports, scoped map[string]string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.Hashes[path] = hash
+	g.Edges[path] = edges
+	g.Nodes[path] = &Node{Path: path, Imports: imports, Scoped: scoped}
+}
+
+// node returns the cached node for path, if any.
+func (g *DepGraph) node(path string) (*Node, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, ok := g.Nodes[path]
+	return n, ok
+}
+
+// isDirty reports whether path needs to be reprocessed: either its content
+// hash has changed since the last build, or any file it (transitively)
+// depends on has. memo short-circuits repeated subtrees and tentatively
+// treats a node already being evaluated as clean, so import cycles don't
+// cause infinite recursion.
+func (g *DepGraph) isDirty(path string, memo map[string]bool) bool {
+	if dirty, ok := memo[path]; ok {
+		return dirty
+	}
+
+	currentHash, err := hashFile(path)
+	if err != nil {
+		// Can't hash it (e.g. it's an npm specifier rather than a file on
+		// disk yet) - treat as dirty so it gets resolved normally.
+		memo[path] = true
+		return true
+	}
+
+	g.mu.Lock()
+	prevHash, seen := g.Hashes[path]
+	edges := append([]string(nil), g.Edges[path]...)
+	g.mu.Unlock()
+
+	if !seen || prevHash != currentHash {
+		memo[path] = true
+		return true
+	}
+
+	// Tentatively mark clean before recursing so a cycle back to path
+	// resolves to "not dirty because of itself".
+	memo[path] = false
+	for _, dep := range edges {
+		if g.isDirty(dep, memo) {
+			memo[path] = true
+			return true
+		}
+	}
+	return false
+}
+
+// InvalidateGopack marks a single file as changed without requiring a full
+// Gopack rebuild, so the file watcher can surgically dirty just the node
+// that actually changed on disk.
+func InvalidateGopack(path string) {
+	graph := loadDepGraph()
+	graph.mu.Lock()
+	delete(graph.Hashes, path)
+	graph.mu.Unlock()
+	if err := graph.save(); err != nil {
+		fmt.Printf("Could not invalidate %s in Gopack cache: %s\n", path, err)
+	}
+}
@@ -0,0 +1,460 @@
+package build
+
+import (
+	"unicode/utf8"
+)
+
+// ImportKind identifies what kind of ESM construct an ImportRef came from.
+type ImportKind int
+
+const (
+	// ImportKindStatic is a top level `import ... from '...'` statement.
+	ImportKindStatic ImportKind = iota
+	// ImportKindExport is a top level `export ... from '...'` re-export statement.
+	ImportKindExport
+	// ImportKindDynamic is an `import('...')` expression.
+	ImportKindDynamic
+	// ImportKindRequire is a CommonJS `require('...')` call.
+	ImportKindRequire
+)
+
+// ImportRef is a single import/export/dynamic-import specifier found in a
+// source file, along with the byte offsets of the whole statement/expression
+// it was found in. Start/End bound the full statement so callers can rewrite
+// just that span instead of touching the rest of the file.
+type ImportRef struct {
+	Start     int
+	End       int
+	Specifier string
+	Kind      ImportKind
+	// SpecStart/SpecEnd bound just the quoted specifier (including quotes)
+	// within Start:End, so the path itself can be swapped out in place.
+	SpecStart int
+	SpecEnd   int
+}
+
+// jsLexer walks a JS/ESM source file one rune at a time, tracking whether
+// we're inside a string, template literal or comment so that "import"/
+// "export" keywords that merely appear inside those contexts are ignored.
+// This replaces the previous regexp-based pass, which had no notion of
+// lexical context and would rewrite paths found inside string literals or
+// comments.
+type jsLexer struct {
+	src []byte
+	pos int
+}
+
+// parseImports scans src and returns every static import, static re-export
+// and dynamic import() expression it finds, in source order. Anything that
+// looks like one of these constructs but is actually inside a string,
+// template literal or comment is skipped.
+func parseImports(src []byte) []ImportRef {
+	l := &jsLexer{src: src}
+	var refs []ImportRef
+
+	for l.pos < len(l.src) {
+		switch {
+		case l.matchLineComment():
+			l.skipLineComment()
+		case l.matchBlockComment():
+			l.skipBlockComment()
+		case l.matchQuote():
+			l.skipString(l.src[l.pos])
+		case l.matchKeyword("import"):
+			if ref, ok := l.parseImportAt(l.pos); ok {
+				refs = append(refs, ref)
+				l.pos = ref.End
+				continue
+			}
+			l.pos++
+		case l.matchKeyword("export"):
+			if ref, ok := l.parseExportAt(l.pos); ok {
+				refs = append(refs, ref)
+				l.pos = ref.End
+				continue
+			}
+			l.pos++
+		default:
+			l.pos++
+		}
+	}
+
+	return refs
+}
+
+func (l *jsLexer) matchLineComment() bool {
+	return l.pos+1 < len(l.src) && l.src[l.pos] == '/' && l.src[l.pos+1] == '/'
+}
+
+func (l *jsLexer) matchBlockComment() bool {
+	return l.pos+1 < len(l.src) && l.src[l.pos] == '/' && l.src[l.pos+1] == '*'
+}
+
+func (l *jsLexer) matchQuote() bool {
+	if l.pos >= len(l.src) {
+		return false
+	}
+	c := l.src[l.pos]
+	return c == '\'' || c == '"' || c == '`'
+}
+
+func (l *jsLexer) skipLineComment() {
+	for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+		l.pos++
+	}
+}
+
+func (l *jsLexer) skipBlockComment() {
+	l.pos += 2
+	for l.pos+1 < len(l.src) {
+		if l.src[l.pos] == '*' && l.src[l.pos+1] == '/' {
+			l.pos += 2
+			return
+		}
+		l.pos++
+	}
+	l.pos = len(l.src)
+}
+
+// skipString advances past a quoted string or template literal starting at
+// l.pos, honoring backslash escapes and (for template literals) nested
+// `${...}` expressions.
+func (l *jsLexer) skipString(quote byte) {
+	depth := 0
+	l.pos++
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '\\' {
+			l.pos += 2
+			continue
+		}
+		if quote == '`' && c == '$' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '{' {
+			depth++
+			l.pos += 2
+			continue
+		}
+		if depth > 0 {
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+			}
+			l.pos++
+			continue
+		}
+		if c == quote {
+			l.pos++
+			return
+		}
+		l.pos++
+	}
+}
+
+// matchKeyword reports whether the identifier at l.pos is exactly keyword,
+// i.e. not preceded/followed by an identifier character (so "imported" does
+// not match "import").
+func (l *jsLexer) matchKeyword(keyword string) bool {
+	return matchKeywordAt(l.src, l.pos, keyword)
+}
+
+// matchKeywordAt reports whether the identifier at src[p] is exactly
+// keyword, i.e. not preceded/followed by an identifier character (so
+// "fromage" does not match "from").
+func matchKeywordAt(src []byte, p int, keyword string) bool {
+	end := p + len(keyword)
+	if end > len(src) || string(src[p:end]) != keyword {
+		return false
+	}
+	if p > 0 && isIdentRune(rune(src[p-1])) {
+		return false
+	}
+	if end < len(src) && isIdentRune(rune(src[end])) {
+		return false
+	}
+	return true
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '$' ||
+		(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// parseImportAt handles both static imports ("import foo from '...'",
+// "import '...'", "import { a, b } from '...'") and dynamic imports
+// ("import('...')"), as well as "import.meta" which is not an import at all
+// and is skipped.
+func (l *jsLexer) parseImportAt(start int) (ImportRef, bool) {
+	p := start + len("import")
+	p = skipSpace(l.src, p)
+
+	// import.meta is a property access, not a module specifier.
+	if p < len(l.src) && l.src[p] == '.' {
+		return ImportRef{}, false
+	}
+
+	// Dynamic import: import('...') or import(`...`)
+	if p < len(l.src) && l.src[p] == '(' {
+		return parseDynamicImport(l.src, start, p)
+	}
+
+	// Static import: find the trailing quoted specifier, terminated by ';' or
+	// newline, whichever comes first (multi-line named imports span
+	// newlines, so we scan until the statement actually ends).
+	end, specStart, specEnd, ok := findStatementSpecifier(l.src, p)
+	if !ok {
+		return ImportRef{}, false
+	}
+	return ImportRef{
+		Start:     start,
+		End:       end,
+		Specifier: unquote(l.src[specStart:specEnd]),
+		Kind:      ImportKindStatic,
+		SpecStart: specStart,
+		SpecEnd:   specEnd,
+	}, true
+}
+
+// parseExportAt handles re-export statements: "export * from '...'",
+// "export { a, b } from '...'", "export * as ns from '...'". Exports that
+// don't re-export from a module specifier (e.g. "export const x = 1") are
+// not ImportRefs and are skipped.
+func (l *jsLexer) parseExportAt(start int) (ImportRef, bool) {
+	end, specStart, specEnd, ok := findReexportSpecifier(l.src, start+len("export"))
+	if !ok {
+		return ImportRef{}, false
+	}
+	return ImportRef{
+		Start:     start,
+		End:       end,
+		Specifier: unquote(l.src[specStart:specEnd]),
+		Kind:      ImportKindExport,
+		SpecStart: specStart,
+		SpecEnd:   specEnd,
+	}, true
+}
+
+// findStatementSpecifier scans forward from p looking for a `from '...'`
+// clause (or, for bare side-effect imports, a leading quoted specifier)
+// before the statement is closed by a semicolon or newline. It returns the
+// end of the whole statement and the byte range of the quoted specifier.
+func findStatementSpecifier(src []byte, p int) (end, specStart, specEnd int, ok bool) {
+	for p < len(src) {
+		c := src[p]
+		switch {
+		case c == '\'' || c == '"':
+			// Either the specifier of a bare `import '...'`, or the one
+			// following `from`.
+			s := p
+			e := skipQuoted(src, p)
+			if e < 0 {
+				return 0, 0, 0, false
+			}
+			stmtEnd := e
+			// Allow a trailing semicolon to be included in the statement.
+			if stmtEnd < len(src) && src[stmtEnd] == ';' {
+				stmtEnd++
+			}
+			return stmtEnd, s, e, true
+		case c == ';':
+			return 0, 0, 0, false
+		case c == '\n':
+			// Named imports can span multiple lines
+			// ("import {\n  a,\n  b\n} from 'x'"), so only bail out once
+			// we've passed a closing brace/identifier without finding a
+			// specifier on a line by itself with no continuation.
+			if !statementContinues(src, p) {
+				return 0, 0, 0, false
+			}
+		}
+		p++
+	}
+	return 0, 0, 0, false
+}
+
+// findReexportSpecifier scans forward from p (the position right after the
+// "export" keyword) looking for a standalone `from` keyword followed by a
+// quoted specifier, terminated by ';' or newline (unless the statement
+// genuinely continues across the newline, same as findStatementSpecifier).
+// Unlike findStatementSpecifier, a quote reached before any `from` keyword
+// means this export isn't a re-export at all - e.g. `export const url =
+// '...'` or `export function greet() { return 'hi'; }` - so it bails
+// without mistaking that string literal for a module specifier.
+func findReexportSpecifier(src []byte, p int) (end, specStart, specEnd int, ok bool) {
+	sawFrom := false
+	for p < len(src) {
+		c := src[p]
+		switch {
+		case c == '\'' || c == '"':
+			if !sawFrom {
+				return 0, 0, 0, false
+			}
+			s := p
+			e := skipQuoted(src, p)
+			if e < 0 {
+				return 0, 0, 0, false
+			}
+			stmtEnd := e
+			// Allow a trailing semicolon to be included in the statement.
+			if stmtEnd < len(src) && src[stmtEnd] == ';' {
+				stmtEnd++
+			}
+			return stmtEnd, s, e, true
+		case c == ';':
+			return 0, 0, 0, false
+		case c == '\n':
+			if !statementContinues(src, p) {
+				return 0, 0, 0, false
+			}
+		case matchKeywordAt(src, p, "from"):
+			sawFrom = true
+			p += len("from") - 1 // loop's p++ advances past the rest
+		}
+		p++
+	}
+	return 0, 0, 0, false
+}
+
+// statementContinues reports whether, after a newline at position p, the
+// import/export statement is still open (i.e. we haven't run past it
+// without ever finding `from`).
+func statementContinues(src []byte, p int) bool {
+	rest := src[p:]
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case '{', '}', ',', '*':
+			return true
+		default:
+			// Still looks like part of a named-import list or identifier
+			// only if it actually is one; anything else means the statement
+			// already ended without a `from '...'` clause.
+			return isIdentRune(rune(rest[i]))
+		}
+	}
+	return false
+}
+
+func parseDynamicImport(src []byte, start, parenPos int) (ImportRef, bool) {
+	p := skipSpace(src, parenPos+1)
+	if p >= len(src) || (src[p] != '\'' && src[p] != '"' && src[p] != '`') {
+		// Not a plain string literal argument (e.g. a computed expression);
+		// can't statically resolve it.
+		return ImportRef{}, false
+	}
+	specStart := p
+	specEnd := skipQuoted(src, p)
+	if specEnd < 0 {
+		return ImportRef{}, false
+	}
+	p = skipSpace(src, specEnd)
+	if p >= len(src) || src[p] != ')' {
+		return ImportRef{}, false
+	}
+	end := p + 1
+	return ImportRef{
+		Start:     start,
+		End:       end,
+		Specifier: unquote(src[specStart:specEnd]),
+		Kind:      ImportKindDynamic,
+		SpecStart: specStart,
+		SpecEnd:   specEnd,
+	}, true
+}
+
+// skipQuoted returns the index just past the closing quote of the quoted
+// string/template literal starting at p, or -1 if it's unterminated.
+func skipQuoted(src []byte, p int) int {
+	quote := src[p]
+	depth := 0
+	p++
+	for p < len(src) {
+		c := src[p]
+		if c == '\\' {
+			p += 2
+			continue
+		}
+		if quote == '`' && c == '$' && p+1 < len(src) && src[p+1] == '{' {
+			depth++
+			p += 2
+			continue
+		}
+		if depth > 0 {
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+			}
+			p++
+			continue
+		}
+		if c == quote {
+			return p + 1
+		}
+		p++
+	}
+	return -1
+}
+
+func skipSpace(src []byte, p int) int {
+	for p < len(src) {
+		r, size := utf8.DecodeRune(src[p:])
+		if r != ' ' && r != '\t' && r != '\n' && r != '\r' {
+			break
+		}
+		p += size
+	}
+	return p
+}
+
+func unquote(quoted []byte) string {
+	if len(quoted) < 2 {
+		return string(quoted)
+	}
+	return string(quoted[1 : len(quoted)-1])
+}
+
+// parseRequires scans src for CommonJS require('...') calls, using the same
+// string/comment-aware lexer as parseImports so a "require(" inside a
+// string or comment isn't mistaken for a real call.
+func parseRequires(src []byte) []ImportRef {
+	l := &jsLexer{src: src}
+	var refs []ImportRef
+
+	for l.pos < len(l.src) {
+		switch {
+		case l.matchLineComment():
+			l.skipLineComment()
+		case l.matchBlockComment():
+			l.skipBlockComment()
+		case l.matchQuote():
+			l.skipString(l.src[l.pos])
+		case l.matchKeyword("require"):
+			if ref, ok := l.parseRequireAt(l.pos); ok {
+				refs = append(refs, ref)
+				l.pos = ref.End
+				continue
+			}
+			l.pos++
+		default:
+			l.pos++
+		}
+	}
+
+	return refs
+}
+
+// parseRequireAt parses a require('...') call starting at start, reusing the
+// same paren/string-literal scanning as a dynamic import() expression.
+func (l *jsLexer) parseRequireAt(start int) (ImportRef, bool) {
+	p := skipSpace(l.src, start+len("require"))
+	if p >= len(l.src) || l.src[p] != '(' {
+		return ImportRef{}, false
+	}
+	ref, ok := parseDynamicImport(l.src, start, p)
+	if !ok {
+		return ImportRef{}, false
+	}
+	ref.Kind = ImportKindRequire
+	return ref, true
+}
@@ -9,33 +9,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/plentico/plenti/common"
 )
 
-var (
-	// Regexp help:
-	// () = brackets for grouping
-	// \s = space
-	// .* = any character
-	// | = or statement
-	// \n = newline
-	// {0,} = repeat any number of times
-	// \{ = just a closing curly bracket (escaped)
-
-	// Match dynamic import statments, e.g. import("") or import('').
-	reDynamicImport = regexp.MustCompile(`import\((?:'|").*(?:'|")\)`)
-	// Find any import statement in the file (including multiline imports).
-	reStaticImportGoPk = regexp.MustCompile(`(?m)^import(\s)(.*from(.*);|((.*\n){0,})\}(\s)from(.*);)`)
-	// Find all export statements.
-	reStaticExportGoPk = regexp.MustCompile(`export(\s)(.*from(.*);|((.*\n){0,})\}(\s)from(.*);)`)
-	// Find the path specifically (part between single or double quotes).
-	rePath = regexp.MustCompile(`(?:'|").*(?:'|")`)
-)
-
 // Gopack ensures ESM support for NPM dependencies.
 func Gopack(buildPath string) {
 
@@ -43,21 +24,157 @@ func Gopack(buildPath string) {
 
 	Log("\nRunning gopack to build esm support for npm dependencies")
 
+	resetImportMap()
+
+	graph := loadDepGraph()
+	pc := newPackContext(buildPath, graph)
+
 	// Start at the entry point for the app
-	runPack(buildPath, buildPath+"/spa/ejected/main.js")
+	pc.processFile(buildPath + "/spa/ejected/main.js")
+	// Wait for every independent subtree the worker pool picked up along
+	// the way, not just the synchronous part of the entry file's walk.
+	pc.wg.Wait()
+
+	if err := graph.save(); err != nil {
+		fmt.Printf("Could not save Gopack dependency graph: %s\n", err)
+	}
+
+	if err := injectImportMap(buildPath + "/spa/index.html"); err != nil {
+		fmt.Printf("Could not inject import map: %s\n", err)
+	}
 
 }
 
-func runPack(buildPath, convertPath string, alreadyConvertedFiles ...string) error {
+// packContext carries the state shared across a single Gopack run: the
+// persistent dependency graph, a worker pool bounded to runtime.NumCPU()
+// used to process independent files concurrently, and the set of files
+// already claimed this run (replacing the old O(n²) alreadyConvertedFiles
+// slice scan with an O(1) map lookup for cycle detection).
+type packContext struct {
+	buildPath string
+	graph     *DepGraph
 
-	if len(alreadyConvertedFiles) > 0 {
-		for _, convertedFile := range alreadyConvertedFiles {
-			if convertPath == convertedFile {
-				// Exit the function to avoid endless loops where files
-				// reference each other (like main.js and router.svelte)
-				return nil
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	mu      sync.Mutex
+	visited map[string]bool
+
+	npmMu      sync.Mutex
+	npmModules map[string]*npmModuleResult
+}
+
+// npmModuleResult caches the outcome of copying/converting a single npm
+// module, and the sync.Once that guards actually doing that work so it
+// happens exactly once per module per run regardless of how many files
+// import it.
+type npmModuleResult struct {
+	once         sync.Once
+	resolvedPath string
+}
+
+func newPackContext(buildPath string, graph *DepGraph) *packContext {
+	return &packContext{
+		buildPath:  buildPath,
+		graph:      graph,
+		sem:        make(chan struct{}, runtime.NumCPU()),
+		visited:    map[string]bool{},
+		npmModules: map[string]*npmModuleResult{},
+	}
+}
+
+// claim reports whether path hasn't been visited yet this run, marking it
+// visited if so. Guards against cycles where files reference each other
+// (like main.js and router.svelte).
+func (pc *packContext) claim(path string) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.visited[path] {
+		return false
+	}
+	pc.visited[path] = true
+	return true
+}
+
+// resolveAndConvertNpmModule copies module from node_modules to web_modules
+// and, if its resolved entry is CommonJS, converts it to ESM - doing so
+// exactly once per module for the whole run. Without this, two different
+// app files importing the same package (e.g. "svelte") would each be
+// processed by a separate worker-pool goroutine, and both would race to
+// copyNpmModule/convertCJSEntry the same destination files under
+// web_modules concurrently. Every importer of module still gets its own
+// call (scope can differ per importer), but only the first one actually
+// does the copy/convert; the rest just read back its resolvedPath.
+func (pc *packContext) resolveAndConvertNpmModule(module, entryFile, publicURL string) string {
+	pc.npmMu.Lock()
+	res, ok := pc.npmModules[module]
+	if !ok {
+		res = &npmModuleResult{}
+		pc.npmModules[module] = res
+	}
+	pc.npmMu.Unlock()
+
+	res.once.Do(func() {
+		// Copy the whole package, not just the subpath named by module
+		// (e.g. "lodash" for "lodash/debounce").
+		pkgName, _ := splitModuleSpecifier(module)
+		copyNpmModule(pkgName, pc.buildPath+"/spa/web_modules")
+		resolvedPath := pc.buildPath + publicURL
+
+		if filepath.Ext(resolvedPath) == ".js" {
+			// Nested requires inside this module are scoped to the
+			// module's own web_modules directory, not to whichever
+			// importer happened to trigger the conversion first.
+			moduleScope := webModuleScope(pc.buildPath, resolvedPath)
+			pkgCacheDir := filepath.Dir(resolvedPath)
+			convertedPath, convertErr := convertCJSEntry(entryFile, pc.buildPath, pkgCacheDir, nearestPackageDir(entryFile)+"/node_modules", moduleScope, map[string]bool{})
+			if convertErr != nil {
+				fmt.Printf("Could not convert CJS module '%s' to ESM: %s\n", module, convertErr)
+			} else {
+				resolvedPath = convertedPath
 			}
 		}
+
+		res.resolvedPath = resolvedPath
+	})
+
+	return res.resolvedPath
+}
+
+// processFileAsync schedules child on the worker pool (bounded to
+// runtime.NumCPU() concurrent files) and returns immediately; Gopack waits
+// on pc.wg for every scheduled file, transitively, before it's done.
+func (pc *packContext) processFileAsync(child string) {
+	pc.wg.Add(1)
+	go func() {
+		defer pc.wg.Done()
+		pc.sem <- struct{}{}
+		defer func() { <-pc.sem }()
+		pc.processFile(child)
+	}()
+}
+
+// processFile converts a single file's imports to ESM-friendly paths, the
+// same way the old runPack did, but: uses the persistent DepGraph to skip
+// files whose content (and whose transitive dependencies) haven't changed
+// since the last build, and dispatches independent local imports onto the
+// worker pool instead of recursing synchronously.
+func (pc *packContext) processFile(convertPath string) error {
+
+	if !pc.claim(convertPath) {
+		// Exit the function to avoid endless loops where files
+		// reference each other (like main.js and router.svelte)
+		return nil
+	}
+
+	if !pc.graph.isDirty(convertPath, map[string]bool{}) {
+		// Unchanged since the last build and so is everything it depends
+		// on: reuse its cached import map contribution instead of
+		// re-reading, re-parsing and re-writing the file.
+		if node, ok := pc.graph.node(convertPath); ok {
+			pc.replayImportMap(convertPath, node)
+			return nil
+		}
 	}
 
 	contentBytes, err := ioutil.ReadFile(convertPath)
@@ -65,31 +182,38 @@ func runPack(buildPath, convertPath string, alreadyConvertedFiles ...string) err
 		return fmt.Errorf("Could not read file %s to convert to esm: %w%s\n", convertPath, err, common.Caller())
 	}
 
-	// Created byte array of all dynamic imports in the current file.
-	dynamicImportPaths := reDynamicImport.FindAll(contentBytes, -1)
-	for _, dynamicImportPath := range dynamicImportPaths {
-		// Inside the dynamic import change any svelte file extensions to reference regular javascript files.
-		fixedImportPath := bytes.Replace(dynamicImportPath, []byte(".svelte"), []byte(".js"), 1)
-		// Add the updated import back into the file contents for writing later.
-		contentBytes = bytes.Replace(contentBytes, dynamicImportPath, fixedImportPath, 1)
-	}
+	// Walk the file once, tracking string/comment/template-literal state, to
+	// collect every static import, re-export and dynamic import() as a
+	// structured ImportRef instead of relying on regexps (which can't tell a
+	// real import from one that's merely quoted inside a string or comment).
+	refs := parseImports(contentBytes)
+
+	var edges []string
+	imports := map[string]string{}
+	scoped := map[string]string{}
+
+	var out bytes.Buffer
+	cursor := 0
+	for _, ref := range refs {
+		pathStr := ref.Specifier
+
+		// Dynamic imports only ever need their svelte->js extension fixed up;
+		// they're not traversed for further npm/local resolution.
+		if ref.Kind == ImportKindDynamic {
+			if filepath.Ext(pathStr) != ".svelte" {
+				continue
+			}
+			out.Write(contentBytes[cursor:ref.SpecStart])
+			out.WriteString(requote(contentBytes[ref.SpecStart], strings.Replace(pathStr, ".svelte", ".js", 1)))
+			cursor = ref.SpecEnd
+			continue
+		}
 
-	// Get all the import statements.
-	staticImportStatements := reStaticImportGoPk.FindAll(contentBytes, -1)
-	// Get all the export statements.
-	staticExportStatements := reStaticExportGoPk.FindAll(contentBytes, -1)
-	// Combine import and export statements.
-	allStaticStatements := append(staticImportStatements, staticExportStatements...)
-	// Iterate through all static import and export statements.
-	for _, staticStatement := range allStaticStatements {
-		// Get path from the full import/export statement.
-		pathBytes := rePath.Find(staticStatement)
-		// Convert path to a string.
-		pathStr := string(pathBytes)
-		// Remove single or double quotes around path.
-		pathStr = strings.Trim(pathStr, `'"`)
 		// Intialize the path that we are replacing.
 		var foundPath string
+		// Bare npm specifiers are left untouched in source; they're resolved
+		// by the browser against the generated import map instead.
+		leaveAsIs := false
 
 		// Convert .svelte file extensions to .js so the browser can read them.
 		if filepath.Ext(pathStr) == ".svelte" {
@@ -101,107 +225,100 @@ func runPack(buildPath, convertPath string, alreadyConvertedFiles ...string) err
 		fullPathStr := path.Clean(path.Dir(convertPath) + "/" + pathStr)
 		// Check that it exists (catches both converted files and those already in .js format)
 		if fileExists(fullPathStr) {
-			fmt.Println("fullpath: " + fullPathStr)
-			fmt.Println("convertpath: " + convertPath)
 			// Set this as a found path.
 			foundPath = pathStr
-			// Add the current file to list of already converted files.
-			alreadyConvertedFiles = append(alreadyConvertedFiles, convertPath)
-			// Use fullPathStr recursively to find its imports.
-			runPack(buildPath, fullPathStr, alreadyConvertedFiles...)
+			edges = append(edges, fullPathStr)
+			// Independent subtrees (files that don't import each other)
+			// can be converted in parallel; the worker pool bounds how many
+			// run at once to runtime.NumCPU().
+			pc.processFileAsync(fullPathStr)
 		}
 
 		// Make sure the import/export path doesn't start with a dot (.) or double dot (..)
 		// and make sure that the path doesn't have a file extension.
-		if pathStr[:1] != "." && filepath.Ext(pathStr) == "" {
-			// Copy the npm file from /node_modules to /spa/web_modules
-			copyNpmModule(pathStr, buildPath+"/spa/web_modules")
-			// Try to connect the path to the file that was copied
-			foundPath = checkNpmPath(buildPath, pathStr)
-			// Make absolute foundPath relative to the current file so it works with baseurls.
-			foundPath, err = filepath.Rel(path.Dir(convertPath), foundPath)
-			if err != nil {
-				fmt.Printf("Could not make path to NPM dependency relative: %s", err)
+		if pathStr != "" && !strings.HasPrefix(pathStr, ".") && filepath.Ext(pathStr) == "" {
+			// Resolve the real entry point for this npm dependency, honoring
+			// package.json "exports"/"module"/"main" instead of guessing at
+			// whichever .js file happens to sort last in the directory.
+			entryFile, publicURL, resolveErr := resolveNpmEntry(pathStr, "node_modules")
+			if resolveErr != nil {
+				fmt.Printf("Could not resolve NPM entry for '%s': %s\n", pathStr, resolveErr)
+			} else {
+				// Copy the npm file from /node_modules to /spa/web_modules,
+				// converting it from CommonJS to ESM first if needed (cached
+				// by source mtime+size so an unchanged dependency isn't
+				// reconverted every build). Deduped per module so two
+				// different importers of the same package don't race each
+				// other writing the same destination files.
+				resolvedPath := pc.resolveAndConvertNpmModule(pathStr, entryFile, publicURL)
+				edges = append(edges, resolvedPath)
+
+				// Record the specifier -> public URL mapping for the
+				// generated import map instead of rewriting this path in
+				// source. Imports made from within an already-resolved npm
+				// dependency are scoped to that dependency's own directory
+				// so a transitive dependency pinned to a different version
+				// elsewhere doesn't get clobbered.
+				scope := webModuleScope(pc.buildPath, convertPath)
+				mappedURL := "/" + strings.TrimPrefix(strings.Replace(resolvedPath, pc.buildPath, "", 1), "/")
+				recordImportMapEntry(scope, pathStr, mappedURL)
+				if scope == "" {
+					imports[pathStr] = mappedURL
+				} else {
+					scoped[pathStr] = mappedURL
+				}
+				leaveAsIs = true
 			}
 		}
 
-		if foundPath != "" {
+		out.Write(contentBytes[cursor:ref.SpecStart])
+		switch {
+		case leaveAsIs:
+			out.Write(contentBytes[ref.SpecStart:ref.SpecEnd])
+		case foundPath != "":
 			// Remove "public" build dir from path.
-			replacePath := strings.Replace(foundPath, buildPath, "", 1)
-			// Wrap path in quotes.
-			replacePath = "'" + replacePath + "'"
-			// Convert string path to bytes.
-			replacePathBytes := []byte(replacePath)
-			// Actually replace the path to the dependency in the source content.
-			contentBytes = bytes.ReplaceAll(contentBytes, staticStatement,
-				rePath.ReplaceAll(staticStatement, rePath.ReplaceAll(pathBytes, replacePathBytes)))
-		} else {
+			replacePath := strings.Replace(foundPath, pc.buildPath, "", 1)
+			out.WriteString(requote(contentBytes[ref.SpecStart], replacePath))
+		default:
 			fmt.Printf("Import path '%s' not resolvable from file '%s'\n", pathStr, convertPath)
+			out.Write(contentBytes[ref.SpecStart:ref.SpecEnd])
 		}
+		cursor = ref.SpecEnd
 	}
+	out.Write(contentBytes[cursor:])
+
 	// Overwrite the old file with the new content that contains the updated import path.
-	err = ioutil.WriteFile(convertPath, contentBytes, 0644)
-	if err != nil {
+	if err := ioutil.WriteFile(convertPath, out.Bytes(), 0644); err != nil {
 		return fmt.Errorf("Could not overwite %s with new import: %w%s\n", convertPath, err, common.Caller())
 	}
-	return nil
-
-}
-
-func checkNpmPath(buildPath, pathStr string) string {
-	// A named import/export is being used, look for this in "web_modules/" dir.
-	namedPath := buildPath + "/spa/web_modules/" + pathStr
-
-	// Check all files in the current directory first.
-	foundPath := findJSFile(namedPath)
 
-	// our loop goes till we have no matching prefix in SeacrhPath so this is as far as that goes.
-	if foundPath == "" {
-		// If JS file was not found in the current directory, check nested directories.
-		findSubPathErr := filepath.WalkDir(namedPath, func(subPath string, subPathFileInfo fs.DirEntry, err error) error {
-			if err != nil {
-				fmt.Printf("Can't walk path %s: %s\n", subPath, err)
-			}
-			// We've already checked all files, so look in next dir.
-			if subPathFileInfo.IsDir() {
-				// Check for any JS files at this dir level.
-				foundPath = findJSFile(subPath)
-				// Stop searching when a file is found
-				if foundPath != "" {
-					// Return a known error
-					return io.EOF
-				}
-
-			}
-			return nil
-		})
-		// Check for known error used to break out of walk
-		if findSubPathErr == io.EOF {
-			findSubPathErr = nil
-		}
-		// Check for real errors
-		if findSubPathErr != nil {
-			fmt.Printf("Could not find related .js file from named import: %s\n", findSubPathErr)
-		}
+	hash, err := hashFile(convertPath)
+	if err != nil {
+		return fmt.Errorf("Could not hash %s for the Gopack dependency graph: %w%s\n", convertPath, err, common.Caller())
 	}
-	return foundPath
-}
+	pc.graph.recordNode(convertPath, hash, edges, imports, scoped)
 
-// Checks for a JS file in the directory given.
-func findJSFile(path string) string {
+	return nil
+}
 
-	var foundPath string
-	files, err := os.ReadDir(path)
-	if err != nil {
-		fmt.Printf("Could not read files in dir '%s': %s\n", path, err)
+// replayImportMap re-applies the import map entries a skipped, unchanged
+// node contributed on a previous build.
+func (pc *packContext) replayImportMap(convertPath string, node *Node) {
+	scope := webModuleScope(pc.buildPath, convertPath)
+	for specifier, url := range node.Imports {
+		recordImportMapEntry("", specifier, url)
 	}
-	for _, f := range files {
-		if filepath.Ext(f.Name()) == ".js" || filepath.Ext(f.Name()) == ".mjs" {
-			foundPath = path + "/" + f.Name()
-		}
+	for specifier, url := range node.Scoped {
+		recordImportMapEntry(scope, specifier, url)
 	}
+}
 
-	return foundPath
+// requote wraps replacement in the same quote character used by original
+// (the first byte of the quoted specifier this is replacing), so rewriting a
+// path doesn't change whether the source used single, double or backtick
+// quotes.
+func requote(quote byte, replacement string) string {
+	return string(quote) + replacement + string(quote)
 }
 
 func fileExists(path string) bool {
@@ -219,11 +336,15 @@ func copyNpmModule(module string, gopackDir string) {
 		if err != nil {
 			return fmt.Errorf("can't stat %s: %w", modulePath, err)
 		}
-		// Only get ESM supported files.
-		if !moduleFileInfo.IsDir() && filepath.Ext(modulePath) == ".mjs" {
+		// Copy any file the resolved entry point could plausibly import:
+		// the package's own .mjs/.js files (the resolved entry itself may
+		// be CJS) plus its package.json, which resolveNpmEntry needs when
+		// this package is later required as a transitive dependency.
+		ext := filepath.Ext(modulePath)
+		if !moduleFileInfo.IsDir() && (ext == ".mjs" || ext == ".js" || filepath.Base(modulePath) == "package.json") {
 			from, err := os.Open(modulePath)
 			if err != nil {
-				return fmt.Errorf("Could not open source .mjs %s file for copying: %w%s\n", modulePath, err, common.Caller())
+				return fmt.Errorf("Could not open source %s file for copying: %w%s\n", modulePath, err, common.Caller())
 			}
 			defer from.Close()
 
@@ -242,7 +363,7 @@ func copyNpmModule(module string, gopackDir string) {
 
 			_, err = io.Copy(to, from)
 			if err != nil {
-				return fmt.Errorf("Could not copy .mjs  from source to destination: %w%s\n", err, common.Caller())
+				return fmt.Errorf("Could not copy %s from source to destination: %w%s\n", modulePath, err, common.Caller())
 			}
 		}
 		return nil
@@ -0,0 +1,117 @@
+package build
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/plentico/plenti/common"
+)
+
+// ImportMap maps bare module specifiers (e.g. "svelte", "navaid") to the
+// public /spa/web_modules/... URL Gopack resolved them to. Browsers resolve
+// ESM bare specifiers against this map natively, so Gopack no longer needs
+// to rewrite every occurrence of a bare import path inside source files.
+var ImportMap = map[string]string{}
+
+// ImportMapScopes holds per-importer overrides for bare specifiers that
+// resolve differently depending on which module is doing the importing
+// (e.g. two npm dependencies that each bundle a different version of the
+// same transitive dependency). It's keyed by the scope's URL prefix, same
+// as the "scopes" key of a browser import map.
+var ImportMapScopes = map[string]map[string]string{}
+
+// importMapMu guards ImportMap/ImportMapScopes, which are written from the
+// worker pool Gopack uses to process independent files concurrently.
+var importMapMu sync.Mutex
+
+// resetImportMap clears the maps populated by the previous Gopack run.
+func resetImportMap() {
+	importMapMu.Lock()
+	defer importMapMu.Unlock()
+	ImportMap = map[string]string{}
+	ImportMapScopes = map[string]map[string]string{}
+}
+
+// recordImportMapEntry records that specifier resolves to publicURL.
+// scopeURL is the public URL prefix of the file doing the importing; an
+// empty scopeURL records a global mapping, while a non-empty one (set when
+// the importer itself lives under /spa/web_modules/) records a scoped
+// override so it doesn't clobber a different version of the same specifier
+// imported from elsewhere.
+func recordImportMapEntry(scopeURL, specifier, publicURL string) {
+	importMapMu.Lock()
+	defer importMapMu.Unlock()
+	if scopeURL == "" {
+		ImportMap[specifier] = publicURL
+		return
+	}
+	if ImportMapScopes[scopeURL] == nil {
+		ImportMapScopes[scopeURL] = map[string]string{}
+	}
+	ImportMapScopes[scopeURL][specifier] = publicURL
+}
+
+// webModuleScope returns the /spa/web_modules/... directory URL that
+// convertPath should be scoped under, or "" if convertPath isn't itself an
+// npm dependency (i.e. it's app source, so its imports belong in the global
+// map).
+func webModuleScope(buildPath, convertPath string) string {
+	prefix := buildPath + "/spa/web_modules/"
+	if !strings.HasPrefix(convertPath, prefix) {
+		return ""
+	}
+	rel := strings.TrimPrefix(convertPath, buildPath)
+	return path.Dir(rel) + "/"
+}
+
+// reInjectedImportMap matches a previously injected import map tag so
+// injectImportMap can replace it instead of piling up a second one.
+var reInjectedImportMap = regexp.MustCompile(`<script type="importmap">.*?</script>`)
+
+// injectImportMap marshals the generated ImportMap/ImportMapScopes into a
+// `<script type="importmap">` tag and inserts it just before `</head>` in
+// htmlPath. It's a no-op (not an error) if htmlPath doesn't exist yet, since
+// not every build produces an HTML shell before Gopack runs.
+func injectImportMap(htmlPath string) error {
+	if !fileExists(htmlPath) {
+		return nil
+	}
+
+	htmlBytes, err := ioutil.ReadFile(htmlPath)
+	if err != nil {
+		return fmt.Errorf("Could not read %s to inject import map: %w%s\n", htmlPath, err, common.Caller())
+	}
+
+	// An incremental/watch build reuses the same index.html across runs, so
+	// strip any import map a previous run injected before adding the new
+	// one - browsers reject a document with more than one import map.
+	htmlBytes = reInjectedImportMap.ReplaceAll(htmlBytes, nil)
+
+	mapJSON, err := json.Marshal(struct {
+		Imports map[string]string            `json:"imports"`
+		Scopes  map[string]map[string]string `json:"scopes,omitempty"`
+	}{
+		Imports: ImportMap,
+		Scopes:  ImportMapScopes,
+	})
+	if err != nil {
+		return fmt.Errorf("Could not marshal import map: %w%s\n", err, common.Caller())
+	}
+
+	tag := fmt.Sprintf(`<script type="importmap">%s</script>`, mapJSON)
+	if !bytes.Contains(htmlBytes, []byte("</head>")) {
+		return fmt.Errorf("Could not find </head> in %s to inject import map%s\n", htmlPath, common.Caller())
+	}
+	htmlBytes = bytes.Replace(htmlBytes, []byte("</head>"), []byte(tag+"</head>"), 1)
+
+	if err := ioutil.WriteFile(htmlPath, htmlBytes, 0644); err != nil {
+		return fmt.Errorf("Could not write %s with injected import map: %w%s\n", htmlPath, err, common.Caller())
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// packageJSON is the subset of package.json fields involved in resolving an
+// npm package's ESM entry point.
+type packageJSON struct {
+	Name    string          `json:"name"`
+	Main    string          `json:"main"`
+	Module  string          `json:"module"`
+	JSNext  string          `json:"jsnext:main"`
+	Exports json.RawMessage `json:"exports"`
+}
+
+// resolveConditions are tried, in order, against a package.json "exports"
+// conditional map. "default" is implicit and always tried last.
+var resolveConditions = []string{"import", "browser"}
+
+// resolveNpmEntry resolves a bare module specifier (optionally with a
+// subpath, e.g. "lodash/debounce") to a concrete file on disk plus the
+// stable public URL it will be copied to under /spa/web_modules/. It
+// replaces the old copyNpmModule/checkNpmPath directory-walk heuristic,
+// which assumed every package shipped a flat pile of .mjs files and broke on
+// CJS-only packages or packages using conditional "exports".
+//
+// nodeModulesDir is the node_modules directory to resolve module against;
+// pass "node_modules" for top level imports and
+// "<pkgDir>/node_modules" when recursively resolving a dependency's own
+// transitive dependencies.
+func resolveNpmEntry(module, nodeModulesDir string) (entryFile, publicURL string, err error) {
+	pkgName, subpath := splitModuleSpecifier(module)
+
+	pkgDir, err := findPackageDir(pkgName, nodeModulesDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	pkg, err := readPackageJSON(pkgDir)
+	if err != nil {
+		return "", "", err
+	}
+
+	var relEntry string
+	if pkg.Exports != nil {
+		relEntry, err = resolveExportsField(pkg.Exports, subpath)
+	}
+	if relEntry == "" {
+		if subpath != "" {
+			// No "exports" field (or it didn't resolve this subpath): treat
+			// the subpath as a direct file path relative to the package
+			// root, same as Node does for packages without "exports".
+			relEntry, err = resolveDirectSubpath(pkgDir, subpath)
+		} else {
+			relEntry = firstNonEmpty(pkg.Module, pkg.JSNext, pkg.Main, "index.js")
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if relEntry == "" {
+		return "", "", fmt.Errorf("could not resolve an entry point for %q in %s", module, pkgDir)
+	}
+
+	entryFile = filepath.Join(pkgDir, relEntry)
+	if _, statErr := os.Stat(entryFile); statErr != nil {
+		return "", "", fmt.Errorf("resolved entry %s for %q does not exist: %w", entryFile, module, statErr)
+	}
+
+	// The package may have been found in a hoisted ancestor node_modules
+	// rather than nodeModulesDir itself, so the URL is made relative to the
+	// node_modules directory that actually holds pkgDir.
+	pkgRoot := pkgDir
+	for range strings.Split(pkgName, "/") {
+		pkgRoot = filepath.Dir(pkgRoot)
+	}
+	relToNodeModules, err := filepath.Rel(pkgRoot, entryFile)
+	if err != nil {
+		return "", "", fmt.Errorf("could not make %s relative to %s: %w", entryFile, pkgRoot, err)
+	}
+	publicURL = "/spa/web_modules/" + filepath.ToSlash(relToNodeModules)
+
+	return entryFile, publicURL, nil
+}
+
+// splitModuleSpecifier splits a bare specifier into its package name and
+// subpath, honoring scoped packages (@scope/name/subpath).
+func splitModuleSpecifier(module string) (pkgName, subpath string) {
+	parts := strings.Split(module, "/")
+	if strings.HasPrefix(module, "@") && len(parts) >= 2 {
+		pkgName = strings.Join(parts[:2], "/")
+		if len(parts) > 2 {
+			subpath = strings.Join(parts[2:], "/")
+		}
+		return
+	}
+	pkgName = parts[0]
+	if len(parts) > 1 {
+		subpath = strings.Join(parts[1:], "/")
+	}
+	return
+}
+
+func findPackageDir(pkgName, nodeModulesDir string) (string, error) {
+	pkgDir := filepath.Join(nodeModulesDir, pkgName)
+	if info, err := os.Stat(pkgDir); err == nil && info.IsDir() {
+		return pkgDir, nil
+	}
+	// Mirror Node's upward node_modules search for transitive deps that
+	// were hoisted to an ancestor node_modules instead of being nested
+	// under the requiring package.
+	// Start from the package that owns nodeModulesDir and check the
+	// node_modules of each ancestor, skipping ancestors that are themselves
+	// node_modules directories.
+	dir := filepath.Dir(nodeModulesDir)
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+		if filepath.Base(dir) == "node_modules" {
+			continue
+		}
+		candidate := filepath.Join(dir, "node_modules", pkgName)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("could not find package %q under %s", pkgName, nodeModulesDir)
+}
+
+func readPackageJSON(pkgDir string) (*packageJSON, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(pkgDir, "package.json"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read package.json in %s: %w", pkgDir, err)
+	}
+	pkg := &packageJSON{}
+	if err := json.Unmarshal(raw, pkg); err != nil {
+		return nil, fmt.Errorf("could not parse package.json in %s: %w", pkgDir, err)
+	}
+	return pkg, nil
+}
+
+// resolveExportsField resolves subpath ("" for the package root) against a
+// package.json "exports" field, which may be:
+//   - a single string ("./index.js")
+//   - a conditions map ({"import": "...", "default": "..."})
+//   - a subpath map ({".": "...", "./feature": "...", "./*": "./dist/*.js"})
+//
+// where each value may itself be a nested conditions map.
+func resolveExportsField(raw json.RawMessage, subpath string) (string, error) {
+	var asString string
+	if err := json.Unmarshal(raw, &asString); err == nil {
+		if subpath == "" {
+			return strings.TrimPrefix(asString, "./"), nil
+		}
+		return "", nil
+	}
+
+	var asMap map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &asMap); err != nil {
+		return "", fmt.Errorf("could not parse \"exports\" field: %w", err)
+	}
+
+	wantKey := "."
+	if subpath != "" {
+		wantKey = "./" + subpath
+	}
+
+	// Exact subpath match.
+	if v, ok := asMap[wantKey]; ok {
+		return resolveExportsCondition(v)
+	}
+
+	// Subpath not found directly: is this a conditions map instead of a
+	// subpath map (i.e. keys are "import"/"default"/etc, not "./...")? That
+	// only applies to the package root.
+	if subpath == "" {
+		if entry, ok := firstCondition(asMap); ok {
+			return resolveExportsCondition(entry)
+		}
+	}
+
+	// Wildcard subpath patterns, e.g. "./*": "./dist/*.js".
+	for pattern, v := range asMap {
+		prefix, suffix, ok := splitWildcard(pattern)
+		if !ok || !strings.HasPrefix(wantKey, prefix) || !strings.HasSuffix(wantKey, suffix) {
+			continue
+		}
+		matched := strings.TrimSuffix(strings.TrimPrefix(wantKey, prefix), suffix)
+		target, err := resolveExportsCondition(v)
+		if err != nil || target == "" {
+			continue
+		}
+		targetPrefix, targetSuffix, ok := splitWildcard(target)
+		if !ok {
+			continue
+		}
+		return targetPrefix + matched + targetSuffix, nil
+	}
+
+	return "", nil
+}
+
+func splitWildcard(pattern string) (prefix, suffix string, ok bool) {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return "", "", false
+	}
+	return pattern[:i], pattern[i+1:], true
+}
+
+// firstCondition looks for any of the known condition keys in a raw
+// "exports" map, falling back to "default".
+func firstCondition(m map[string]json.RawMessage) (json.RawMessage, bool) {
+	for _, cond := range resolveConditions {
+		if v, ok := m[cond]; ok {
+			return v, true
+		}
+	}
+	if v, ok := m["default"]; ok {
+		return v, true
+	}
+	return nil, false
+}
+
+// resolveExportsCondition resolves a single exports value, which may be a
+// plain path string or a nested conditions map.
+func resolveExportsCondition(raw json.RawMessage) (string, error) {
+	var asString string
+	if err := json.Unmarshal(raw, &asString); err == nil {
+		return strings.TrimPrefix(asString, "./"), nil
+	}
+	var asMap map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &asMap); err != nil {
+		return "", fmt.Errorf("could not parse \"exports\" condition: %w", err)
+	}
+	entry, ok := firstCondition(asMap)
+	if !ok {
+		return "", nil
+	}
+	return resolveExportsCondition(entry)
+}
+
+// resolveDirectSubpath resolves a bare subpath import for a package with no
+// (or non-matching) "exports" field, trying the path as given and then with
+// a .js/.mjs extension appended.
+func resolveDirectSubpath(pkgDir, subpath string) (string, error) {
+	candidates := []string{subpath, subpath + ".js", subpath + ".mjs", subpath + "/index.js"}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(filepath.Join(pkgDir, candidate)); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("could not resolve subpath %q in %s", subpath, pkgDir)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}